@@ -0,0 +1,89 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdp
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func Test_MatchRDP_UnmarshalCaddyfile(t *testing.T) {
+	type test struct {
+		config  string
+		want    *MatchRDP
+		wantErr bool
+	}
+
+	tests := []test{
+		{
+			config: `rdp {
+				cookie_hash a0123
+				cookie_hash_regexp ^a.*
+				cookie_ports 3389 3390
+				cookie_ips 10.0.0.0/8 192.168.0.0/16
+				custom_info vendor-data
+				custom_info_regexp ^vendor.*
+			}`,
+			want: &MatchRDP{
+				CookieHash:       "a0123",
+				CookieHashRegexp: "^a.*",
+				CookiePorts:      []uint16{3389, 3390},
+				CookieIPs:        []string{"10.0.0.0/8", "192.168.0.0/16"},
+				CustomInfo:       "vendor-data",
+				CustomInfoRegexp: "^vendor.*",
+			},
+		},
+		{config: `rdp arg`, wantErr: true},
+		{config: `rdp { bogus }`, wantErr: true},
+		{config: `rdp { cookie_ports }`, wantErr: true},
+		{config: `rdp { cookie_ports notaport }`, wantErr: true},
+	}
+
+	for i, tc := range tests {
+		m := &MatchRDP{}
+		d := caddyfile.NewTestDispenser(tc.config)
+		err := m.UnmarshalCaddyfile(d)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("test %d: expected an error, got none", i)
+			}
+			continue
+		}
+		assertNoError(t, err)
+		if m.CookieHash != tc.want.CookieHash ||
+			m.CookieHashRegexp != tc.want.CookieHashRegexp ||
+			m.CustomInfo != tc.want.CustomInfo ||
+			m.CustomInfoRegexp != tc.want.CustomInfoRegexp {
+			t.Fatalf("test %d: got %+v, want %+v", i, m, tc.want)
+		}
+		if len(m.CookiePorts) != len(tc.want.CookiePorts) {
+			t.Fatalf("test %d: cookie ports = %v, want %v", i, m.CookiePorts, tc.want.CookiePorts)
+		}
+		for j := range m.CookiePorts {
+			if m.CookiePorts[j] != tc.want.CookiePorts[j] {
+				t.Fatalf("test %d: cookie ports = %v, want %v", i, m.CookiePorts, tc.want.CookiePorts)
+			}
+		}
+		if len(m.CookieIPs) != len(tc.want.CookieIPs) {
+			t.Fatalf("test %d: cookie ips = %v, want %v", i, m.CookieIPs, tc.want.CookieIPs)
+		}
+		for j := range m.CookieIPs {
+			if m.CookieIPs[j] != tc.want.CookieIPs[j] {
+				t.Fatalf("test %d: cookie ips = %v, want %v", i, m.CookieIPs, tc.want.CookieIPs)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdp
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/96368a/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&HandlerRDP{})
+}
+
+// HandlerRDP asserts that MatchRDP already recognized the connection as an
+// RDP Connection Request TPDU and exposed the routing cookie hash and the
+// routing token's target IP/port as connection variables, so that a
+// `layer4.proxy` handler placed later in the same route can pick an
+// upstream by them. It must be placed after MatchRDP in the same route.
+// HandlerRDP does not read from the connection and does not modify it in
+// any way: it returns an error when none of those variables is set, and
+// otherwise calls next, leaving the original bytes untouched for the next
+// handler to read.
+type HandlerRDP struct{}
+
+// CaddyModule returns the Caddy module information.
+func (h *HandlerRDP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.rdp",
+		New: func() caddy.Module { return new(HandlerRDP) },
+	}
+}
+
+// Handle confirms that MatchRDP already set the l4.rdp.* connection
+// variables during the matching phase and invokes next. It does not
+// re-decode the Connection Request; it only relies on the variables that
+// MatchRDP set from it.
+func (h *HandlerRDP) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	if cx.GetVar("l4.rdp.cookie_hash") == nil && cx.GetVar("l4.rdp.routing_ip") == nil &&
+		cx.GetVar("l4.rdp.correlation_id") == nil {
+		return errors.New("l4rdp: no l4.rdp.* connection variables set; HandlerRDP must follow MatchRDP in the same route")
+	}
+
+	return next.Handle(cx)
+}
+
+// Interface guards
+var (
+	_ caddy.Module       = (*HandlerRDP)(nil)
+	_ layer4.NextHandler = (*HandlerRDP)(nil)
+)
@@ -0,0 +1,779 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4rdp contains a layer4 matcher and handler for the Remote Desktop
+// Protocol. It recognizes the TPKT/X.224 Connection Request TPDU described
+// in [MS-RDPBCGR] 2.2.1.1, along with the routing cookie and routing token
+// that RD Connection Broker deployments use to steer a client towards the
+// server that is hosting its session.
+package l4rdp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+
+	"github.com/96368a/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRDP{})
+}
+
+// ASCII codes used to delimit the textual parts of an RDP Connection
+// Request TPDU.
+const (
+	ASCIIByteCR = byte(0x0D)
+	ASCIIByteLF = byte(0x0A)
+)
+
+// RDPCookiePrefix is the prefix of an RDP routing cookie that carries a
+// hashed identifier, see [MS-RDPBCGR] 2.2.1.1.1.
+const RDPCookiePrefix = "Cookie: mstshash="
+
+// RDPTokenPrefix is the prefix of an RDP routing token that carries the
+// address of the target server chosen by a connection broker, see
+// [MS-RDPBCGR] 3.3.5.3.
+const RDPTokenPrefix = "Cookie: msts="
+
+const (
+	tpktHeaderLen   = 4
+	x224CrqLen      = 7
+	x224CodeCR      = byte(0xE0)
+	rdpNegReqLen    = 8
+	rdpNegReqType   = byte(0x01)
+	rdpCorrInfoLen  = 36
+	rdpCorrInfoType = byte(0x06)
+)
+
+// TPKTHeader is a TPKT header as defined in [T.123] and used to frame every
+// X.224 TPDU exchanged during the RDP connection sequence.
+type TPKTHeader struct {
+	Version  byte
+	Reserved byte
+	Length   uint16
+}
+
+// FromBytes parses a TPKTHeader out of exactly 4 bytes.
+func (s *TPKTHeader) FromBytes(b []byte) error {
+	if len(b) != tpktHeaderLen {
+		return fmt.Errorf("l4rdp: invalid TPKTHeader length %d", len(b))
+	}
+	s.Version = b[0]
+	s.Reserved = b[1]
+	s.Length = binary.BigEndian.Uint16(b[2:4])
+	return nil
+}
+
+// ToBytes serializes the TPKTHeader back to 4 bytes.
+func (s *TPKTHeader) ToBytes() ([]byte, error) {
+	b := make([]byte, tpktHeaderLen)
+	b[0] = s.Version
+	b[1] = s.Reserved
+	binary.BigEndian.PutUint16(b[2:4], s.Length)
+	return b, nil
+}
+
+// X224Crq is an X.224 Connection Request (CR) TPDU, see [MS-RDPBCGR] 2.2.1.1.
+type X224Crq struct {
+	LengthIndicator byte
+	Code            byte
+	DstRef          uint16
+	SrcRef          uint16
+	ClassOption     byte
+}
+
+// FromBytes parses an X224Crq out of exactly 7 bytes.
+func (s *X224Crq) FromBytes(b []byte) error {
+	if len(b) != x224CrqLen {
+		return fmt.Errorf("l4rdp: invalid X224Crq length %d", len(b))
+	}
+	s.LengthIndicator = b[0]
+	s.Code = b[1]
+	s.DstRef = binary.BigEndian.Uint16(b[2:4])
+	s.SrcRef = binary.BigEndian.Uint16(b[4:6])
+	s.ClassOption = b[6]
+	return nil
+}
+
+// ToBytes serializes the X224Crq back to 7 bytes.
+func (s *X224Crq) ToBytes() ([]byte, error) {
+	b := make([]byte, x224CrqLen)
+	b[0] = s.LengthIndicator
+	b[1] = s.Code
+	binary.BigEndian.PutUint16(b[2:4], s.DstRef)
+	binary.BigEndian.PutUint16(b[4:6], s.SrcRef)
+	b[6] = s.ClassOption
+	return b, nil
+}
+
+// RDPToken is a routing token optionally carried by the Connection Request
+// TPDU. For backwards compatibility with Terminal Services Session
+// Directory, it wraps its own TPKTHeader/X224Crq pair around a textual
+// "Cookie: msts=" cookie that encodes the target server IP, port and a
+// reserved field, see [MS-RDPBCGR] 3.3.5.3.
+type RDPToken struct {
+	Header   TPKTHeader
+	Crq      X224Crq
+	IP       uint32
+	Port     uint16
+	Reserved uint16
+}
+
+// FromBytes parses an RDPToken out of its wire representation.
+func (s *RDPToken) FromBytes(b []byte) error {
+	if len(b) < tpktHeaderLen+x224CrqLen+len(RDPTokenPrefix)+2 {
+		return errors.New("l4rdp: RDPToken is too short")
+	}
+	if err := s.Header.FromBytes(b[0:tpktHeaderLen]); err != nil {
+		return err
+	}
+	if err := s.Crq.FromBytes(b[tpktHeaderLen : tpktHeaderLen+x224CrqLen]); err != nil {
+		return err
+	}
+	rest := string(b[tpktHeaderLen+x224CrqLen:])
+	if !strings.HasPrefix(rest, RDPTokenPrefix) {
+		return errors.New("l4rdp: RDPToken is missing its cookie prefix")
+	}
+	rest = rest[len(RDPTokenPrefix):]
+	if len(rest) < 2 || rest[len(rest)-2] != ASCIIByteCR || rest[len(rest)-1] != ASCIIByteLF {
+		return errors.New("l4rdp: RDPToken is not terminated with a CRLF")
+	}
+	fields := strings.Split(rest[:len(rest)-2], ".")
+	if len(fields) != 3 {
+		return errors.New("l4rdp: RDPToken must have 3 dot-separated fields")
+	}
+	ip, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("l4rdp: invalid RDPToken IP field: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return fmt.Errorf("l4rdp: invalid RDPToken port field: %w", err)
+	}
+	reserved, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil {
+		return fmt.Errorf("l4rdp: invalid RDPToken reserved field: %w", err)
+	}
+	s.IP = uint32(ip)
+	s.Port = uint16(port)
+	s.Reserved = uint16(reserved)
+	return nil
+}
+
+// ToBytes serializes the RDPToken back to its wire representation. The
+// nested TPKTHeader/X224Crq length fields are always recomputed from the
+// current IP/Port/Reserved fields, so a caller that only sets those three
+// fields (e.g. to inject a fresh routing token) does not need to also fill
+// in the nested header by hand.
+func (s *RDPToken) ToBytes() ([]byte, error) {
+	body := fmt.Sprintf("%s%d.%d.%04d%s%s", RDPTokenPrefix, s.IP, s.Port, s.Reserved,
+		string(ASCIIByteCR), string(ASCIIByteLF))
+
+	header := s.Header
+	header.Version = 3
+	header.Reserved = 0
+	header.Length = uint16(tpktHeaderLen + x224CrqLen + len(body))
+	hb, err := header.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	crq := s.Crq
+	crq.Code = x224CodeCR
+	crq.LengthIndicator = byte(x224CrqLen + len(body) - 1)
+	cb, err := crq.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(hb)+len(cb)+len(body))
+	b = append(b, hb...)
+	b = append(b, cb...)
+	b = append(b, body...)
+	return b, nil
+}
+
+// NewRoutingToken builds an RDPToken that points at ip/port, suitable for
+// injecting into a ConnectionRequest as a routing token chosen by a
+// connection broker. The wire format only has room for a 32-bit IPv4
+// address, so ip must be an IPv4 address. port is byte-swapped before
+// being stored, the same quirk RoutingPort() undoes on the way out, so
+// that a real RDP client decodes it back to the port it was given.
+func NewRoutingToken(ip net.IP, port uint16) (*RDPToken, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("l4rdp: routing token target %s is not an IPv4 address", ip)
+	}
+	return &RDPToken{
+		IP:   binary.LittleEndian.Uint32(ip4),
+		Port: port<<8 | port>>8,
+	}, nil
+}
+
+// RoutingIP returns the target server IP address decoded from the token.
+// The IP field is packed in host (little-endian) byte order rather than
+// network byte order, a long-standing quirk of the Windows implementation
+// that session directory/connection broker clients still have to match.
+func (s *RDPToken) RoutingIP() net.IP {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, s.IP)
+	return net.IP(b)
+}
+
+// RoutingPort returns the target server TCP port decoded from the token.
+// Like the IP field, the Port field is byte-swapped relative to its usual
+// network byte order, so it must be unswapped before it means anything to
+// callers comparing against a real port number.
+func (s *RDPToken) RoutingPort() uint16 {
+	return s.Port<<8 | s.Port>>8
+}
+
+// RDPNegReq is an RDP Negotiation Request, see [MS-RDPBCGR] 2.2.1.1.1.
+type RDPNegReq struct {
+	Type               byte
+	Flags              byte
+	Length             uint16
+	RequestedProtocols uint32
+}
+
+// FromBytes parses an RDPNegReq out of exactly 8 bytes.
+func (s *RDPNegReq) FromBytes(b []byte) error {
+	if len(b) != rdpNegReqLen {
+		return fmt.Errorf("l4rdp: invalid RDPNegReq length %d", len(b))
+	}
+	if b[0] != rdpNegReqType {
+		return fmt.Errorf("l4rdp: invalid RDPNegReq type 0x%02x", b[0])
+	}
+	s.Type = b[0]
+	s.Flags = b[1]
+	s.Length = binary.LittleEndian.Uint16(b[2:4])
+	if s.Length != rdpNegReqLen {
+		return fmt.Errorf("l4rdp: invalid RDPNegReq length field %d", s.Length)
+	}
+	s.RequestedProtocols = binary.LittleEndian.Uint32(b[4:8])
+	return nil
+}
+
+// ToBytes serializes the RDPNegReq back to 8 bytes.
+func (s *RDPNegReq) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpNegReqLen)
+	b[0] = s.Type
+	b[1] = s.Flags
+	binary.LittleEndian.PutUint16(b[2:4], s.Length)
+	binary.LittleEndian.PutUint32(b[4:8], s.RequestedProtocols)
+	return b, nil
+}
+
+// RDPCorrInfo is an RDP Correlation Info, see [MS-RDPBCGR] 2.2.1.1.2. It
+// lets a TCP main channel be correlated with its UDP side-channels by
+// comparing their Uuid fields.
+type RDPCorrInfo struct {
+	Type     byte
+	Flags    byte
+	Length   uint16
+	Uuid     [16]byte
+	Reserved [16]byte
+}
+
+// FromBytes parses an RDPCorrInfo out of exactly 36 bytes.
+func (s *RDPCorrInfo) FromBytes(b []byte) error {
+	if len(b) != rdpCorrInfoLen {
+		return fmt.Errorf("l4rdp: invalid RDPCorrInfo length %d", len(b))
+	}
+	if b[0] != rdpCorrInfoType {
+		return fmt.Errorf("l4rdp: invalid RDPCorrInfo type 0x%02x", b[0])
+	}
+	s.Type = b[0]
+	s.Flags = b[1]
+	s.Length = binary.LittleEndian.Uint16(b[2:4])
+	if s.Length != rdpCorrInfoLen {
+		return fmt.Errorf("l4rdp: invalid RDPCorrInfo length field %d", s.Length)
+	}
+	copy(s.Uuid[:], b[4:20])
+	copy(s.Reserved[:], b[20:36])
+	return nil
+}
+
+// ToBytes serializes the RDPCorrInfo back to 36 bytes.
+func (s *RDPCorrInfo) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpCorrInfoLen)
+	b[0] = s.Type
+	b[1] = s.Flags
+	binary.LittleEndian.PutUint16(b[2:4], s.Length)
+	copy(b[4:20], s.Uuid[:])
+	copy(b[20:36], s.Reserved[:])
+	return b, nil
+}
+
+// ConnectionRequest is the result of decoding a Connection Request TPDU.
+// It is shared between MatchRDP and other packages, such as l4rdpproxy,
+// so that both agree on what counts as a well-formed RDP handshake.
+type ConnectionRequest struct {
+	Header     TPKTHeader
+	Crq        X224Crq
+	CookieHash string
+	Token      *RDPToken
+	CustomInfo string
+	NegReq     *RDPNegReq
+	CorrInfo   *RDPCorrInfo
+}
+
+// decodeRDPConnectionRequest decodes a Connection Request TPDU out of b,
+// which must hold exactly one TPDU and nothing else.
+func decodeRDPConnectionRequest(b []byte) (*ConnectionRequest, error) {
+	if len(b) < tpktHeaderLen+x224CrqLen {
+		return nil, errors.New("l4rdp: packet is too short")
+	}
+
+	req := &ConnectionRequest{}
+	if err := req.Header.FromBytes(b[0:tpktHeaderLen]); err != nil {
+		return nil, err
+	}
+	if int(req.Header.Length) != len(b) {
+		return nil, errors.New("l4rdp: TPKTHeader length does not match the packet")
+	}
+	if err := req.Crq.FromBytes(b[tpktHeaderLen : tpktHeaderLen+x224CrqLen]); err != nil {
+		return nil, err
+	}
+	if req.Crq.Code != x224CodeCR {
+		return nil, fmt.Errorf("l4rdp: not an X.224 Connection Request, got code 0x%02x", req.Crq.Code)
+	}
+	if int(req.Crq.LengthIndicator) != len(b)-tpktHeaderLen-1 {
+		return nil, errors.New("l4rdp: X224Crq length indicator does not match the packet")
+	}
+
+	rest := b[tpktHeaderLen+x224CrqLen:]
+
+	// An optional routing cookie, routing token or vendor-specific custom
+	// info may appear first, always terminated with a CRLF.
+	switch {
+	case len(rest) >= tpktHeaderLen+x224CrqLen+len(RDPTokenPrefix) &&
+		rest[0] == 0x03 && rest[1] == 0x00 && rest[5] == x224CodeCR:
+		idx := indexCRLF(rest)
+		if idx < 0 {
+			return nil, errors.New("l4rdp: RDPToken is not terminated with a CRLF")
+		}
+		token := &RDPToken{}
+		if err := token.FromBytes(rest[:idx+2]); err != nil {
+			return nil, err
+		}
+		req.Token = token
+		rest = rest[idx+2:]
+	case strings.HasPrefix(string(rest), RDPCookiePrefix):
+		idx := indexCRLF(rest)
+		if idx < 0 {
+			return nil, errors.New("l4rdp: RDPCookie is not terminated with a CRLF")
+		}
+		hash := string(rest[len(RDPCookiePrefix):idx])
+		if len(hash) == 0 {
+			return nil, errors.New("l4rdp: RDPCookie hash must have at least 1 symbol")
+		}
+		req.CookieHash = hash
+		rest = rest[idx+2:]
+	default:
+		if idx := indexCRLF(rest); idx >= 0 && !looksLikeRDPNegReq(rest) {
+			if idx == 0 {
+				return nil, errors.New("l4rdp: custom info must have at least 1 symbol")
+			}
+			req.CustomInfo = string(rest[:idx])
+			rest = rest[idx+2:]
+		}
+	}
+
+	switch len(rest) {
+	case 0:
+	case rdpNegReqLen, rdpNegReqLen + rdpCorrInfoLen:
+		negReq := &RDPNegReq{}
+		if err := negReq.FromBytes(rest[:rdpNegReqLen]); err != nil {
+			return nil, err
+		}
+		req.NegReq = negReq
+		rest = rest[rdpNegReqLen:]
+		if len(rest) == rdpCorrInfoLen {
+			corrInfo := &RDPCorrInfo{}
+			if err := corrInfo.FromBytes(rest); err != nil {
+				return nil, err
+			}
+			req.CorrInfo = corrInfo
+			rest = nil
+		}
+	default:
+		return nil, fmt.Errorf("l4rdp: unexpected %d trailing bytes", len(rest))
+	}
+
+	if req.CookieHash == "" && req.Token == nil && req.CustomInfo == "" && req.NegReq == nil {
+		return nil, errors.New("l4rdp: not enough information to confirm this is RDP")
+	}
+	return req, nil
+}
+
+// looksLikeRDPNegReq reports whether b starts with a plausible RDPNegReq,
+// used to decide whether a CRLF found in the remaining bytes belongs to a
+// custom info string rather than to binary negotiation data.
+func looksLikeRDPNegReq(b []byte) bool {
+	return len(b) >= 1 && b[0] == rdpNegReqType
+}
+
+// indexCRLF returns the index of the first CRLF sequence in b, or -1.
+func indexCRLF(b []byte) int {
+	for i := 0; i+1 < len(b); i++ {
+		if b[i] == ASCIIByteCR && b[i+1] == ASCIIByteLF {
+			return i
+		}
+	}
+	return -1
+}
+
+// maxRDPConnectionRequestLen bounds the TPKTHeader length field accepted by
+// readRDPConnectionRequest, so a malicious or garbled length field cannot
+// make it allocate or block on an unreasonable amount of data.
+const maxRDPConnectionRequestLen = 2048
+
+// readRDPConnectionRequest reads the TPKTHeader, then reads exactly the
+// number of bytes it declares, and decodes the result as a single
+// Connection Request TPDU. It must not read more than that: a real client
+// sends only the Connection Request and then blocks waiting for our
+// Connection Confirm, so a read bounded by EOF rather than by the declared
+// length would never return.
+func readRDPConnectionRequest(cx *layer4.Connection) (*ConnectionRequest, error) {
+	header := make([]byte, tpktHeaderLen)
+	if _, err := io.ReadFull(cx, header); err != nil {
+		return nil, err
+	}
+	var h TPKTHeader
+	if err := h.FromBytes(header); err != nil {
+		return nil, err
+	}
+	if int(h.Length) < tpktHeaderLen || int(h.Length) > maxRDPConnectionRequestLen {
+		return nil, fmt.Errorf("l4rdp: invalid TPKTHeader length %d", h.Length)
+	}
+
+	rest := make([]byte, int(h.Length)-tpktHeaderLen)
+	if _, err := io.ReadFull(cx, rest); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(header)+len(rest))
+	buf = append(buf, header...)
+	buf = append(buf, rest...)
+	return decodeRDPConnectionRequest(buf)
+}
+
+// DecodeConnectionRequest decodes a Connection Request TPDU out of b, which
+// must hold exactly one TPDU and nothing else. It is exported so that other
+// packages, such as l4rdpproxy, can decode and rewrite a request without
+// depending on MatchRDP having run first.
+func DecodeConnectionRequest(b []byte) (*ConnectionRequest, error) {
+	return decodeRDPConnectionRequest(b)
+}
+
+// ReadConnectionRequest reads the TPKTHeader, then exactly the number of
+// bytes it declares, and decodes the result as a single Connection Request
+// TPDU.
+func ReadConnectionRequest(cx *layer4.Connection) (*ConnectionRequest, error) {
+	return readRDPConnectionRequest(cx)
+}
+
+// ToBytes re-serializes the Connection Request, recomputing the TPKTHeader
+// and X224Crq lengths to match its current contents. Callers that mutate
+// CookieHash, Token, CustomInfo or NegReq.RequestedProtocols before calling
+// ToBytes can use it to forward a rewritten Connection Request upstream.
+func (req *ConnectionRequest) ToBytes() ([]byte, error) {
+	var body []byte
+
+	switch {
+	case req.Token != nil:
+		tb, err := req.Token.ToBytes()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, tb...)
+	case req.CookieHash != "":
+		body = append(body, RDPCookiePrefix...)
+		body = append(body, req.CookieHash...)
+		body = append(body, ASCIIByteCR, ASCIIByteLF)
+	case req.CustomInfo != "":
+		body = append(body, req.CustomInfo...)
+		body = append(body, ASCIIByteCR, ASCIIByteLF)
+	}
+
+	if req.NegReq != nil {
+		nb, err := req.NegReq.ToBytes()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, nb...)
+		if req.CorrInfo != nil {
+			cb, err := req.CorrInfo.ToBytes()
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, cb...)
+		}
+	}
+
+	req.Crq.Code = x224CodeCR
+	req.Crq.LengthIndicator = byte(x224CrqLen + len(body) - 1)
+	crqBytes, err := req.Crq.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Version = 3
+	req.Header.Reserved = 0
+	req.Header.Length = uint16(tpktHeaderLen + x224CrqLen + len(body))
+	headerBytes, err := req.Header.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(headerBytes)+len(crqBytes)+len(body))
+	out = append(out, headerBytes...)
+	out = append(out, crqBytes...)
+	out = append(out, body...)
+	return out, nil
+}
+
+// MatchRDP matches RDP Connection Request TPDUs, optionally filtering on
+// the routing cookie hash, the routing token's target IP/port, or a
+// vendor-specific custom info string.
+type MatchRDP struct {
+	// CookieHash matches a literal routing cookie hash (the `mstshash=`
+	// value).
+	CookieHash string `json:"cookie_hash,omitempty"`
+	// CookieHashRegexp matches the routing cookie hash against a regular
+	// expression.
+	CookieHashRegexp string `json:"cookie_hash_regexp,omitempty"`
+	// CookiePorts restricts matching to routing tokens that target one of
+	// these TCP ports.
+	CookiePorts []uint16 `json:"cookie_ports,omitempty"`
+	// CookieIPs restricts matching to routing tokens that target an IP
+	// address within one of these CIDR ranges.
+	CookieIPs []string `json:"cookie_ips,omitempty"`
+	// CustomInfo matches a literal vendor-specific custom info string.
+	CustomInfo string `json:"custom_info,omitempty"`
+	// CustomInfoRegexp matches the custom info string against a regular
+	// expression.
+	CustomInfoRegexp string `json:"custom_info_regexp,omitempty"`
+
+	cookieHashRegexp *regexp.Regexp
+	customInfoRegexp *regexp.Regexp
+	cookieIPNets     []*net.IPNet
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchRDP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.rdp",
+		New: func() caddy.Module { return new(MatchRDP) },
+	}
+}
+
+// Provision prepares m's internal state.
+func (m *MatchRDP) Provision(_ caddy.Context) error {
+	if m.CookieHashRegexp != "" {
+		re, err := regexp.Compile(m.CookieHashRegexp)
+		if err != nil {
+			return fmt.Errorf("l4rdp: invalid cookie_hash_regexp: %w", err)
+		}
+		m.cookieHashRegexp = re
+	}
+	if m.CustomInfoRegexp != "" {
+		re, err := regexp.Compile(m.CustomInfoRegexp)
+		if err != nil {
+			return fmt.Errorf("l4rdp: invalid custom_info_regexp: %w", err)
+		}
+		m.customInfoRegexp = re
+	}
+	m.cookieIPNets = make([]*net.IPNet, 0, len(m.CookieIPs))
+	for _, cidr := range m.CookieIPs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("l4rdp: invalid cookie_ips entry %q: %w", cidr, err)
+		}
+		m.cookieIPNets = append(m.cookieIPNets, ipNet)
+	}
+	return nil
+}
+
+// Match returns true if the connection looks like an RDP Connection
+// Request TPDU that satisfies all configured filters.
+func (m *MatchRDP) Match(cx *layer4.Connection) (bool, error) {
+	req, err := readRDPConnectionRequest(cx)
+	if err != nil {
+		// layer4.ErrConsumedAllPrefetchedBytes means there isn't enough
+		// prefetched data yet to decide, not that this definitely isn't RDP;
+		// it must propagate so the route-matching loop retries with more
+		// data instead of giving up on the connection.
+		if errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if m.CookieHash != "" && req.CookieHash != m.CookieHash {
+		return false, nil
+	}
+	if m.cookieHashRegexp != nil && !m.cookieHashRegexp.MatchString(req.CookieHash) {
+		return false, nil
+	}
+	if len(m.CookiePorts) > 0 {
+		if req.Token == nil {
+			return false, nil
+		}
+		found := false
+		for _, port := range m.CookiePorts {
+			if port == req.Token.RoutingPort() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if len(m.cookieIPNets) > 0 {
+		if req.Token == nil {
+			return false, nil
+		}
+		found := false
+		ip := req.Token.RoutingIP()
+		for _, ipNet := range m.cookieIPNets {
+			if ipNet.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if m.CustomInfo != "" && req.CustomInfo != m.CustomInfo {
+		return false, nil
+	}
+	if m.customInfoRegexp != nil && !m.customInfoRegexp.MatchString(req.CustomInfo) {
+		return false, nil
+	}
+
+	// Expose the decoded routing information so that a downstream
+	// layer4.proxy can pick an upstream based on it without re-parsing the
+	// handshake, and a HandlerRDP placed after this matcher can check that
+	// it was set.
+	if req.CookieHash != "" {
+		cx.SetVar("l4.rdp.cookie_hash", req.CookieHash)
+	}
+	if req.Token != nil {
+		cx.SetVar("l4.rdp.routing_ip", req.Token.RoutingIP().String())
+		cx.SetVar("l4.rdp.routing_port", req.Token.RoutingPort())
+	}
+	if req.CorrInfo != nil {
+		cx.SetVar("l4.rdp.correlation_id", req.CorrInfo.Uuid)
+	}
+
+	return true, nil
+}
+
+// UnmarshalCaddyfile sets up the MatchRDP from Caddyfile tokens. Syntax:
+//
+//	rdp {
+//		cookie_hash <hash>
+//		cookie_hash_regexp <pattern>
+//		cookie_ports <port...>
+//		cookie_ips <cidr...>
+//		custom_info <info>
+//		custom_info_regexp <pattern>
+//	}
+func (m *MatchRDP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		if len(args) > 0 {
+			return d.ArgErr()
+		}
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			opt := d.Val()
+			switch opt {
+			case "cookie_hash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CookieHash = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "cookie_hash_regexp":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CookieHashRegexp = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "cookie_ports":
+				ports := d.RemainingArgs()
+				if len(ports) == 0 {
+					return d.ArgErr()
+				}
+				for _, p := range ports {
+					port, err := strconv.ParseUint(p, 10, 16)
+					if err != nil {
+						return d.Errf("invalid cookie_ports entry %q: %v", p, err)
+					}
+					m.CookiePorts = append(m.CookiePorts, uint16(port))
+				}
+			case "cookie_ips":
+				ips := d.RemainingArgs()
+				if len(ips) == 0 {
+					return d.ArgErr()
+				}
+				m.CookieIPs = append(m.CookieIPs, ips...)
+			case "custom_info":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CustomInfo = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "custom_info_regexp":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CustomInfoRegexp = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*MatchRDP)(nil)
+	_ caddy.Provisioner     = (*MatchRDP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchRDP)(nil)
+	_ layer4.ConnMatcher    = (*MatchRDP)(nil)
+)
@@ -0,0 +1,205 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/96368a/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(&MatchRDPUDP{})
+}
+
+const (
+	rdpUDPHeaderLen  = 6
+	rdpUDPSynDataLen = 8
+
+	// RDPUDPFlagSyn marks the first datagram of an MS-RDPEUDP connection,
+	// see [MS-RDPEUDP] 2.2.1.
+	RDPUDPFlagSyn = uint16(0x0001)
+	// RDPUDPFlagSynLossy additionally marks the SYN of the lossy transport
+	// variant used by RDP 8+ for graphics side-channels.
+	RDPUDPFlagSynLossy = uint16(0x0020)
+	// rdpUDPFlagCorrelationID marks the presence of a trailing 16-byte
+	// RDPUDP2 correlation ID, negotiated over the TCP main channel via
+	// RDPCorrInfo, appended after the SYN payload.
+	rdpUDPFlagCorrelationID = uint16(0x8000)
+)
+
+// RDPUDPHeader is the header prepended to every MS-RDPEUDP datagram.
+type RDPUDPHeader struct {
+	SnSourceAck       uint16
+	ReceiveWindowSize uint16
+	Flags             uint16
+}
+
+// FromBytes parses an RDPUDPHeader out of exactly 6 bytes.
+func (s *RDPUDPHeader) FromBytes(b []byte) error {
+	if len(b) != rdpUDPHeaderLen {
+		return fmt.Errorf("l4rdp: invalid RDPUDPHeader length %d", len(b))
+	}
+	s.SnSourceAck = binary.LittleEndian.Uint16(b[0:2])
+	s.ReceiveWindowSize = binary.LittleEndian.Uint16(b[2:4])
+	s.Flags = binary.LittleEndian.Uint16(b[4:6])
+	return nil
+}
+
+// ToBytes serializes the RDPUDPHeader back to 6 bytes.
+func (s *RDPUDPHeader) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpUDPHeaderLen)
+	binary.LittleEndian.PutUint16(b[0:2], s.SnSourceAck)
+	binary.LittleEndian.PutUint16(b[2:4], s.ReceiveWindowSize)
+	binary.LittleEndian.PutUint16(b[4:6], s.Flags)
+	return b, nil
+}
+
+// RDPUDPSynData is the payload that follows an RDPUDPHeader whose Flags
+// carry RDPUDPFlagSyn or RDPUDPFlagSynLossy, see [MS-RDPEUDP] 2.2.2.1/2.2.2.2.
+type RDPUDPSynData struct {
+	SnInitialSequenceNumber uint32
+	UpstreamMtu             uint16
+	DownstreamMtu           uint16
+}
+
+// FromBytes parses an RDPUDPSynData out of exactly 8 bytes.
+func (s *RDPUDPSynData) FromBytes(b []byte) error {
+	if len(b) != rdpUDPSynDataLen {
+		return fmt.Errorf("l4rdp: invalid RDPUDPSynData length %d", len(b))
+	}
+	s.SnInitialSequenceNumber = binary.LittleEndian.Uint32(b[0:4])
+	s.UpstreamMtu = binary.LittleEndian.Uint16(b[4:6])
+	s.DownstreamMtu = binary.LittleEndian.Uint16(b[6:8])
+	return nil
+}
+
+// ToBytes serializes the RDPUDPSynData back to 8 bytes.
+func (s *RDPUDPSynData) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpUDPSynDataLen)
+	binary.LittleEndian.PutUint32(b[0:4], s.SnInitialSequenceNumber)
+	binary.LittleEndian.PutUint16(b[4:6], s.UpstreamMtu)
+	binary.LittleEndian.PutUint16(b[6:8], s.DownstreamMtu)
+	return b, nil
+}
+
+// MatchRDPUDP matches the SYN datagram of an MS-RDPEUDP connection, the UDP
+// transport used to carry RDP 8+ side-channels (e.g. the graphics channel)
+// alongside the TCP main channel matched by MatchRDP. When the client
+// includes an RDPUDP2 correlation ID, it can be filtered on and is the same
+// value carried by RDPCorrInfo.Uuid on the TCP side, letting a single config
+// route both to the same backend.
+type MatchRDPUDP struct {
+	// CorrelationID matches a hex-encoded RDPUDP2 correlation ID, the same
+	// value exposed as l4.rdp.correlation_id by MatchRDP.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	correlationID [16]byte
+}
+
+// CaddyModule returns the Caddy module information.
+func (m *MatchRDPUDP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.rdp_udp",
+		New: func() caddy.Module { return new(MatchRDPUDP) },
+	}
+}
+
+// Provision prepares m's internal state.
+func (m *MatchRDPUDP) Provision(_ caddy.Context) error {
+	if m.CorrelationID == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(m.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("l4rdp: invalid correlation_id: %w", err)
+	}
+	if len(b) != len(m.correlationID) {
+		return fmt.Errorf("l4rdp: correlation_id must be %d bytes, got %d", len(m.correlationID), len(b))
+	}
+	copy(m.correlationID[:], b)
+	return nil
+}
+
+// Match returns true if the datagram is an MS-RDPEUDP SYN that satisfies
+// the configured correlation ID filter, if any.
+func (m *MatchRDPUDP) Match(cx *layer4.Connection) (bool, error) {
+	buf := make([]byte, 2048)
+	n, err := cx.Read(buf)
+	if err != nil {
+		// layer4.ErrConsumedAllPrefetchedBytes means there isn't enough
+		// prefetched data yet to decide, not that this definitely isn't an
+		// MS-RDPEUDP SYN; it must propagate so the route-matching loop
+		// retries with more data instead of giving up on the connection.
+		if errors.Is(err, layer4.ErrConsumedAllPrefetchedBytes) {
+			return false, err
+		}
+		return false, nil
+	}
+	buf = buf[:n]
+
+	if len(buf) < rdpUDPHeaderLen+rdpUDPSynDataLen {
+		return false, nil
+	}
+
+	header := &RDPUDPHeader{}
+	if err := header.FromBytes(buf[:rdpUDPHeaderLen]); err != nil {
+		return false, nil
+	}
+	if header.Flags&RDPUDPFlagSyn == 0 && header.Flags&RDPUDPFlagSynLossy == 0 {
+		return false, nil
+	}
+
+	synData := &RDPUDPSynData{}
+	if err := synData.FromBytes(buf[rdpUDPHeaderLen : rdpUDPHeaderLen+rdpUDPSynDataLen]); err != nil {
+		return false, nil
+	}
+
+	rest := buf[rdpUDPHeaderLen+rdpUDPSynDataLen:]
+	var correlationID [16]byte
+	haveCorrelationID := false
+	if header.Flags&rdpUDPFlagCorrelationID != 0 {
+		if len(rest) < 16 {
+			return false, nil
+		}
+		copy(correlationID[:], rest[:16])
+		haveCorrelationID = true
+	}
+
+	if m.CorrelationID != "" {
+		if !haveCorrelationID || correlationID != m.correlationID {
+			return false, nil
+		}
+	}
+
+	cx.SetVar("l4.rdp.udp_initial_sequence_number", synData.SnInitialSequenceNumber)
+	if haveCorrelationID {
+		cx.SetVar("l4.rdp.correlation_id", correlationID)
+	}
+
+	return true, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module       = (*MatchRDPUDP)(nil)
+	_ caddy.Provisioner  = (*MatchRDPUDP)(nil)
+	_ layer4.ConnMatcher = (*MatchRDPUDP)(nil)
+)
@@ -0,0 +1,145 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+
+	"github.com/96368a/caddy-l4/layer4"
+)
+
+func Test_MatchRDPUDP_ProcessRDPUDPHeader(t *testing.T) {
+	p := [][]byte{
+		packetUDPSyn[0:6], packetUDPSynLossy[0:6], packetUDPSynCorrID[0:6],
+	}
+	for _, b := range p {
+		func() {
+			s := &RDPUDPHeader{}
+			errFrom := s.FromBytes(b)
+			assertNoError(t, errFrom)
+			sb, errTo := s.ToBytes()
+			assertNoError(t, errTo)
+			if !bytes.Equal(b, sb) {
+				t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+			}
+		}()
+	}
+}
+
+func Test_MatchRDPUDP_ProcessRDPUDPSynData(t *testing.T) {
+	p := [][]byte{
+		packetUDPSyn[6:14], packetUDPSynLossy[6:14], packetUDPSynCorrID[6:14],
+	}
+	for _, b := range p {
+		func() {
+			s := &RDPUDPSynData{}
+			errFrom := s.FromBytes(b)
+			assertNoError(t, errFrom)
+			sb, errTo := s.ToBytes()
+			assertNoError(t, errTo)
+			if !bytes.Equal(b, sb) {
+				t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+			}
+		}()
+	}
+}
+
+func Test_MatchRDPUDP_Match(t *testing.T) {
+	type test struct {
+		matcher     *MatchRDPUDP
+		data        []byte
+		shouldMatch bool
+	}
+
+	tests := []test{
+		{matcher: &MatchRDPUDP{}, data: packetUDPTooShort, shouldMatch: false},
+		{matcher: &MatchRDPUDP{}, data: packetUDPNotSyn, shouldMatch: false},
+		{matcher: &MatchRDPUDP{}, data: packetUDPSyn, shouldMatch: true},
+		{matcher: &MatchRDPUDP{}, data: packetUDPSynLossy, shouldMatch: true},
+		{matcher: &MatchRDPUDP{}, data: packetUDPSynCorrIDTruncated, shouldMatch: false},
+		{matcher: &MatchRDPUDP{}, data: packetUDPSynCorrID, shouldMatch: true},
+		{matcher: &MatchRDPUDP{CorrelationID: "0102030405060708090a0b0c0d0e0f10"}, data: packetUDPSynCorrID, shouldMatch: true},
+		{matcher: &MatchRDPUDP{CorrelationID: "ffffffffffffffffffffffffffffffff"}, data: packetUDPSynCorrID, shouldMatch: false},
+		{matcher: &MatchRDPUDP{CorrelationID: "0102030405060708090a0b0c0d0e0f10"}, data: packetUDPSyn, shouldMatch: false},
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	for i, tc := range tests {
+		func() {
+			err := tc.matcher.Provision(ctx)
+			assertNoError(t, err)
+
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			cx := layer4.WrapConnection(out, []byte{}, zap.NewNop())
+			go func() {
+				_, err := in.Write(tc.data)
+				assertNoError(t, err)
+				_ = in.Close()
+			}()
+
+			matched, err := tc.matcher.Match(cx)
+			assertNoError(t, err)
+
+			if matched != tc.shouldMatch {
+				if tc.shouldMatch {
+					t.Fatalf("test %d: matcher did not match | %+v\n", i, tc.matcher)
+				} else {
+					t.Fatalf("test %d: matcher should not match | %+v\n", i, tc.matcher)
+				}
+			}
+		}()
+	}
+}
+
+// Packet examples
+var packetUDPTooShort = []byte{
+	0x00, 0x00, 0x00, 0x00, // RDPUDPHeader (truncated)
+}
+var packetUDPNotSyn = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // RDPUDPHeader, no SYN flags set
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, // RDPUDPSynData
+}
+var packetUDPSyn = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x01, 0x00, // RDPUDPHeader, RDPUDPFlagSyn
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, // RDPUDPSynData
+}
+var packetUDPSynLossy = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x20, 0x00, // RDPUDPHeader, RDPUDPFlagSynLossy
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, // RDPUDPSynData
+}
+var packetUDPSynCorrIDTruncated = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x01, 0x80, // RDPUDPHeader, RDPUDPFlagSyn | correlation ID flag
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, // RDPUDPSynData
+	0x01, 0x02, 0x03, 0x04, // truncated correlation ID (< 16 bytes)
+}
+var packetUDPSynCorrID = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x01, 0x80, // RDPUDPHeader, RDPUDPFlagSyn | correlation ID flag
+	0x01, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, // RDPUDPSynData
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, // correlation ID
+}
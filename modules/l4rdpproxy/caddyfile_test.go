@@ -0,0 +1,84 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdpproxy
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func Test_Handler_UnmarshalCaddyfile(t *testing.T) {
+	requestedProtocols := uint32(3)
+
+	type test struct {
+		config  string
+		want    *Handler
+		wantErr bool
+	}
+
+	tests := []test{
+		{
+			config: `rdp_proxy 10.0.0.1:3389 10.0.0.2:3389 {
+				requested_protocols 3
+				strip_cookie
+				routing_ip 10.0.0.3
+				routing_port 3389
+			}`,
+			want: &Handler{
+				Upstreams:          []string{"10.0.0.1:3389", "10.0.0.2:3389"},
+				RequestedProtocols: &requestedProtocols,
+				StripCookie:        true,
+				RoutingIP:          "10.0.0.3",
+				RoutingPort:        3389,
+			},
+		},
+		{config: `rdp_proxy`, wantErr: true},
+		{config: `rdp_proxy 10.0.0.1:3389 { bogus }`, wantErr: true},
+		{config: `rdp_proxy 10.0.0.1:3389 { requested_protocols notanumber }`, wantErr: true},
+		{config: `rdp_proxy 10.0.0.1:3389 { routing_port notanumber }`, wantErr: true},
+	}
+
+	for i, tc := range tests {
+		h := &Handler{}
+		d := caddyfile.NewTestDispenser(tc.config)
+		err := h.UnmarshalCaddyfile(d)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("test %d: expected an error, got none", i)
+			}
+			continue
+		}
+		assertNoError(t, err)
+		if len(h.Upstreams) != len(tc.want.Upstreams) {
+			t.Fatalf("test %d: upstreams = %v, want %v", i, h.Upstreams, tc.want.Upstreams)
+		}
+		for j := range h.Upstreams {
+			if h.Upstreams[j] != tc.want.Upstreams[j] {
+				t.Fatalf("test %d: upstreams = %v, want %v", i, h.Upstreams, tc.want.Upstreams)
+			}
+		}
+		if (h.RequestedProtocols == nil) != (tc.want.RequestedProtocols == nil) ||
+			(h.RequestedProtocols != nil && *h.RequestedProtocols != *tc.want.RequestedProtocols) {
+			t.Fatalf("test %d: requested protocols = %v, want %v", i, h.RequestedProtocols, tc.want.RequestedProtocols)
+		}
+		if h.StripCookie != tc.want.StripCookie {
+			t.Fatalf("test %d: strip cookie = %v, want %v", i, h.StripCookie, tc.want.StripCookie)
+		}
+		if h.RoutingIP != tc.want.RoutingIP || h.RoutingPort != tc.want.RoutingPort {
+			t.Fatalf("test %d: routing = %s:%d, want %s:%d", i, h.RoutingIP, h.RoutingPort, tc.want.RoutingIP, tc.want.RoutingPort)
+		}
+	}
+}
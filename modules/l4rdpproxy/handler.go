@@ -0,0 +1,297 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package l4rdpproxy contains a layer4 handler that relays the RDP
+// X.224/[MS-RDPBCGR] negotiation to the backend it dials: it rewrites or
+// strips the client's routing cookie/token before forwarding the
+// Connection Request, can advertise a requestedProtocols mask of its own
+// choosing, and can inject a routing token into the forwarded request. The
+// backend's Connection Confirm is relayed to the client unchanged.
+package l4rdpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+
+	"github.com/96368a/caddy-l4/layer4"
+	"github.com/96368a/caddy-l4/modules/l4rdp"
+)
+
+func init() {
+	caddy.RegisterModule(&Handler{})
+}
+
+// Handler dials one of Upstreams, forwards a rewritten Connection Request
+// TPDU to it, relays the Connection Confirm TPDU back to the client, and
+// then pipes the rest of the connection unmodified.
+type Handler struct {
+	// Upstreams lists the backend addresses to dial, in order, until one
+	// succeeds.
+	Upstreams []string `json:"upstreams,omitempty"`
+
+	// RequestedProtocols, when set, overrides the requestedProtocols mask
+	// advertised to the backend instead of forwarding the client's value.
+	RequestedProtocols *uint32 `json:"requested_protocols,omitempty"`
+
+	// StripCookie removes the client's routing cookie/token before
+	// forwarding the Connection Request to the backend, so that a hash or
+	// token encoding tenant information never reaches it.
+	StripCookie bool `json:"strip_cookie,omitempty"`
+
+	// RoutingIP and RoutingPort, when both set, replace the Connection
+	// Request's routing token with one pointing at RoutingIP:RoutingPort.
+	// The token does not depend on which of Upstreams is dialed, and it is
+	// sent only to the backend inside the forwarded Connection Request;
+	// nothing is sent to the client.
+	RoutingIP   string `json:"routing_ip,omitempty"`
+	RoutingPort uint16 `json:"routing_port,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (h *Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.rdp_proxy",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision prepares h's internal state.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	if len(h.Upstreams) == 0 {
+		return errors.New("l4rdpproxy: at least one upstream is required")
+	}
+	if (h.RoutingIP == "") != (h.RoutingPort == 0) {
+		return errors.New("l4rdpproxy: routing_ip and routing_port must be set together")
+	}
+	if h.RoutingIP != "" {
+		if ip := net.ParseIP(h.RoutingIP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("l4rdpproxy: invalid routing_ip %q, must be an IPv4 address", h.RoutingIP)
+		}
+	}
+	return nil
+}
+
+// Handle rewrites the already-matched Connection Request, forwards it to
+// an upstream, relays the Connection Confirm back to the client, and then
+// pipes the rest of the connection until either side closes.
+func (h *Handler) Handle(cx *layer4.Connection, _ layer4.Handler) error {
+	req, err := l4rdp.ReadConnectionRequest(cx)
+	if err != nil {
+		return fmt.Errorf("l4rdpproxy: decoding Connection Request: %w", err)
+	}
+
+	if err := h.rewrite(req); err != nil {
+		return fmt.Errorf("l4rdpproxy: %w", err)
+	}
+
+	reqBytes, err := req.ToBytes()
+	if err != nil {
+		return fmt.Errorf("l4rdpproxy: re-encoding Connection Request: %w", err)
+	}
+
+	upstream, err := h.dial()
+	if err != nil {
+		return fmt.Errorf("l4rdpproxy: %w", err)
+	}
+	defer upstream.Close()
+
+	if _, err := upstream.Write(reqBytes); err != nil {
+		return fmt.Errorf("l4rdpproxy: forwarding Connection Request: %w", err)
+	}
+
+	ccfBytes, err := readConnectionConfirm(upstream)
+	if err != nil {
+		return fmt.Errorf("l4rdpproxy: reading Connection Confirm: %w", err)
+	}
+	if _, err := cx.Write(ccfBytes); err != nil {
+		return fmt.Errorf("l4rdpproxy: relaying Connection Confirm: %w", err)
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upstream, cx)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(cx, upstream)
+		errc <- err
+	}()
+	err = <-errc
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("l4rdpproxy: %w", err)
+	}
+	return nil
+}
+
+// rewrite applies the configured transformations to req in place.
+func (h *Handler) rewrite(req *l4rdp.ConnectionRequest) error {
+	if h.StripCookie {
+		req.CookieHash = ""
+		req.Token = nil
+	}
+	if h.RoutingIP != "" {
+		token, err := l4rdp.NewRoutingToken(net.ParseIP(h.RoutingIP), h.RoutingPort)
+		if err != nil {
+			return err
+		}
+		req.Token = token
+		req.CookieHash = ""
+	}
+	if h.RequestedProtocols != nil && req.NegReq != nil {
+		req.NegReq.RequestedProtocols = *h.RequestedProtocols
+	}
+	return nil
+}
+
+// dial connects to the first upstream that accepts a TCP connection.
+func (h *Handler) dial() (net.Conn, error) {
+	var lastErr error
+	for _, addr := range h.Upstreams {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		h.logger.Warn("upstream dial failed", zap.String("address", addr), zap.Error(err))
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no upstream reachable, last error: %w", lastErr)
+}
+
+// readConnectionConfirm reads the TPKTHeader/X224Ccf Connection Confirm
+// TPDU that the backend sends back, along with its optional RDPNegRsp or
+// RDPNegFailure, and returns the raw bytes to relay to the client.
+func readConnectionConfirm(conn net.Conn) ([]byte, error) {
+	header := make([]byte, tpktHeaderLen)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	length := int(header[2])<<8 | int(header[3])
+	if length < tpktHeaderLen+x224CrqLen {
+		return nil, fmt.Errorf("l4rdpproxy: Connection Confirm is too short (%d bytes)", length)
+	}
+
+	rest := make([]byte, length-tpktHeaderLen)
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		return nil, err
+	}
+
+	ccf := &X224Ccf{}
+	if err := ccf.FromBytes(rest[:x224CrqLen]); err != nil {
+		return nil, err
+	}
+	if ccf.Code != x224CodeCC {
+		return nil, fmt.Errorf("l4rdpproxy: not an X.224 Connection Confirm, got code 0x%02x", ccf.Code)
+	}
+
+	tail := rest[x224CrqLen:]
+	switch len(tail) {
+	case 0:
+	case rdpNegRspLen:
+		negRsp := &RDPNegRsp{}
+		if err := negRsp.FromBytes(tail); err != nil {
+			if failure := (&RDPNegFailure{}); failure.FromBytes(tail) == nil {
+				break
+			}
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("l4rdpproxy: unexpected %d trailing bytes in Connection Confirm", len(tail))
+	}
+
+	out := make([]byte, 0, len(header)+len(rest))
+	out = append(out, header...)
+	out = append(out, rest...)
+	return out, nil
+}
+
+// UnmarshalCaddyfile sets up the Handler from Caddyfile tokens. Syntax:
+//
+//	rdp_proxy <upstreams...> {
+//		requested_protocols <mask>
+//		strip_cookie
+//		routing_ip   <ip>
+//		routing_port <port>
+//	}
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		h.Upstreams = append(h.Upstreams, d.RemainingArgs()...)
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			opt := d.Val()
+			switch opt {
+			case "requested_protocols":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				mask, err := strconv.ParseUint(d.Val(), 10, 32)
+				if err != nil {
+					return d.Errf("invalid requested_protocols %q: %v", d.Val(), err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				requested := uint32(mask)
+				h.RequestedProtocols = &requested
+			case "strip_cookie":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.StripCookie = true
+			case "routing_ip":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.RoutingIP = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "routing_port":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				port, err := strconv.ParseUint(d.Val(), 10, 16)
+				if err != nil {
+					return d.Errf("invalid routing_port %q: %v", d.Val(), err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				h.RoutingPort = uint16(port)
+			default:
+				return d.ArgErr()
+			}
+		}
+	}
+	if len(h.Upstreams) == 0 {
+		return d.Err("rdp_proxy requires at least one upstream")
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module          = (*Handler)(nil)
+	_ caddy.Provisioner     = (*Handler)(nil)
+	_ caddyfile.Unmarshaler = (*Handler)(nil)
+	_ layer4.NextHandler    = (*Handler)(nil)
+)
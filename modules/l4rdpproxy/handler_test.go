@@ -0,0 +1,137 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdpproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/96368a/caddy-l4/modules/l4rdp"
+)
+
+func Test_Handler_rewrite(t *testing.T) {
+	requestedProtocols := uint32(3)
+
+	type test struct {
+		handler    *Handler
+		req        *l4rdp.ConnectionRequest
+		wantErr    bool
+		wantCookie string
+		wantToken  bool
+	}
+
+	tests := []test{
+		{
+			handler:    &Handler{},
+			req:        &l4rdp.ConnectionRequest{CookieHash: "a0123"},
+			wantCookie: "a0123",
+		},
+		{
+			handler:    &Handler{StripCookie: true},
+			req:        &l4rdp.ConnectionRequest{CookieHash: "a0123"},
+			wantCookie: "",
+		},
+		{
+			handler:   &Handler{RoutingIP: "10.0.0.1", RoutingPort: 3389},
+			req:       &l4rdp.ConnectionRequest{CookieHash: "a0123"},
+			wantToken: true,
+		},
+		{
+			handler: &Handler{RoutingIP: "::1", RoutingPort: 3389},
+			req:     &l4rdp.ConnectionRequest{},
+			wantErr: true,
+		},
+		{
+			handler: &Handler{RequestedProtocols: &requestedProtocols},
+			req:     &l4rdp.ConnectionRequest{NegReq: &l4rdp.RDPNegReq{RequestedProtocols: 0}},
+		},
+	}
+
+	for i, tc := range tests {
+		err := tc.handler.rewrite(tc.req)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("test %d: expected an error, got none", i)
+			}
+			continue
+		}
+		assertNoError(t, err)
+
+		if tc.req.CookieHash != tc.wantCookie {
+			t.Fatalf("test %d: cookie hash = %q, want %q", i, tc.req.CookieHash, tc.wantCookie)
+		}
+		if (tc.req.Token != nil) != tc.wantToken {
+			t.Fatalf("test %d: token set = %v, want %v", i, tc.req.Token != nil, tc.wantToken)
+		}
+		if tc.wantToken && tc.req.Token.RoutingPort() != tc.handler.RoutingPort {
+			t.Fatalf("test %d: token routing port = %d, want %d", i, tc.req.Token.RoutingPort(), tc.handler.RoutingPort)
+		}
+		if tc.handler.RequestedProtocols != nil && tc.req.NegReq != nil &&
+			tc.req.NegReq.RequestedProtocols != *tc.handler.RequestedProtocols {
+			t.Fatalf("test %d: requested protocols = %d, want %d", i, tc.req.NegReq.RequestedProtocols, *tc.handler.RequestedProtocols)
+		}
+	}
+}
+
+func Test_readConnectionConfirm(t *testing.T) {
+	type test struct {
+		data    []byte
+		wantErr bool
+	}
+
+	tests := []test{
+		{data: packetCCfNoNeg[:0], wantErr: true},
+		{data: tpktWrap(packetCCfNoNeg), wantErr: false},
+		{data: tpktWrap(packetCCfNegRsp), wantErr: false},
+		{data: tpktWrap(packetCCfNegFailure), wantErr: false},
+	}
+
+	for i, tc := range tests {
+		func() {
+			in, out := net.Pipe()
+			defer func() {
+				_, _ = io.Copy(io.Discard, out)
+				_ = out.Close()
+			}()
+
+			go func() {
+				_, _ = in.Write(tc.data)
+				_ = in.Close()
+			}()
+
+			b, err := readConnectionConfirm(out)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("test %d: expected an error, got none", i)
+				}
+				return
+			}
+			assertNoError(t, err)
+			if len(b) != len(tc.data) {
+				t.Fatalf("test %d: read %d bytes, want %d", i, len(b), len(tc.data))
+			}
+		}()
+	}
+}
+
+// tpktWrap prepends a TPKTHeader declaring the length of body.
+func tpktWrap(body []byte) []byte {
+	out := make([]byte, 0, tpktHeaderLen+len(body))
+	length := tpktHeaderLen + len(body)
+	out = append(out, 0x03, 0x00, byte(length>>8), byte(length))
+	out = append(out, body...)
+	return out
+}
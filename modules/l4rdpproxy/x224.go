@@ -0,0 +1,138 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdpproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	tpktHeaderLen     = 4
+	x224CrqLen        = 7
+	x224CodeCC        = byte(0xD0)
+	rdpNegRspLen      = 8
+	rdpNegRspType     = byte(0x02)
+	rdpNegFailureLen  = 8
+	rdpNegFailureType = byte(0x03)
+)
+
+// X224Ccf is an X.224 Connection Confirm (CC) TPDU, the server's reply to
+// an X.224 Connection Request, see [MS-RDPBCGR] 2.2.1.2.
+type X224Ccf struct {
+	LengthIndicator byte
+	Code            byte
+	DstRef          uint16
+	SrcRef          uint16
+	ClassOption     byte
+}
+
+// FromBytes parses an X224Ccf out of exactly 7 bytes.
+func (s *X224Ccf) FromBytes(b []byte) error {
+	if len(b) != x224CrqLen {
+		return fmt.Errorf("l4rdpproxy: invalid X224Ccf length %d", len(b))
+	}
+	s.LengthIndicator = b[0]
+	s.Code = b[1]
+	s.DstRef = binary.BigEndian.Uint16(b[2:4])
+	s.SrcRef = binary.BigEndian.Uint16(b[4:6])
+	s.ClassOption = b[6]
+	return nil
+}
+
+// ToBytes serializes the X224Ccf back to 7 bytes.
+func (s *X224Ccf) ToBytes() ([]byte, error) {
+	b := make([]byte, x224CrqLen)
+	b[0] = s.LengthIndicator
+	b[1] = s.Code
+	binary.BigEndian.PutUint16(b[2:4], s.DstRef)
+	binary.BigEndian.PutUint16(b[4:6], s.SrcRef)
+	b[6] = s.ClassOption
+	return b, nil
+}
+
+// RDPNegRsp is an RDP Negotiation Response, the server's positive reply to
+// an RDPNegReq, see [MS-RDPBCGR] 2.2.1.2.1.
+type RDPNegRsp struct {
+	Type             byte
+	Flags            byte
+	Length           uint16
+	SelectedProtocol uint32
+}
+
+// FromBytes parses an RDPNegRsp out of exactly 8 bytes.
+func (s *RDPNegRsp) FromBytes(b []byte) error {
+	if len(b) != rdpNegRspLen {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegRsp length %d", len(b))
+	}
+	if b[0] != rdpNegRspType {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegRsp type 0x%02x", b[0])
+	}
+	s.Type = b[0]
+	s.Flags = b[1]
+	s.Length = binary.LittleEndian.Uint16(b[2:4])
+	if s.Length != rdpNegRspLen {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegRsp length field %d", s.Length)
+	}
+	s.SelectedProtocol = binary.LittleEndian.Uint32(b[4:8])
+	return nil
+}
+
+// ToBytes serializes the RDPNegRsp back to 8 bytes.
+func (s *RDPNegRsp) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpNegRspLen)
+	b[0] = s.Type
+	b[1] = s.Flags
+	binary.LittleEndian.PutUint16(b[2:4], s.Length)
+	binary.LittleEndian.PutUint32(b[4:8], s.SelectedProtocol)
+	return b, nil
+}
+
+// RDPNegFailure is an RDP Negotiation Failure, the server's negative reply
+// to an RDPNegReq, see [MS-RDPBCGR] 2.2.1.2.2.
+type RDPNegFailure struct {
+	Type        byte
+	Flags       byte
+	Length      uint16
+	FailureCode uint32
+}
+
+// FromBytes parses an RDPNegFailure out of exactly 8 bytes.
+func (s *RDPNegFailure) FromBytes(b []byte) error {
+	if len(b) != rdpNegFailureLen {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegFailure length %d", len(b))
+	}
+	if b[0] != rdpNegFailureType {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegFailure type 0x%02x", b[0])
+	}
+	s.Type = b[0]
+	s.Flags = b[1]
+	s.Length = binary.LittleEndian.Uint16(b[2:4])
+	if s.Length != rdpNegFailureLen {
+		return fmt.Errorf("l4rdpproxy: invalid RDPNegFailure length field %d", s.Length)
+	}
+	s.FailureCode = binary.LittleEndian.Uint32(b[4:8])
+	return nil
+}
+
+// ToBytes serializes the RDPNegFailure back to 8 bytes.
+func (s *RDPNegFailure) ToBytes() ([]byte, error) {
+	b := make([]byte, rdpNegFailureLen)
+	b[0] = s.Type
+	b[1] = s.Flags
+	binary.LittleEndian.PutUint16(b[2:4], s.Length)
+	binary.LittleEndian.PutUint32(b[4:8], s.FailureCode)
+	return b, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 VNXME
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package l4rdpproxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+}
+
+func Test_X224Ccf_ProcessBytes(t *testing.T) {
+	p := [][]byte{
+		packetCCfNoNeg[0:7], packetCCfNegRsp[0:7], packetCCfNegFailure[0:7],
+	}
+	for _, b := range p {
+		func() {
+			s := &X224Ccf{}
+			errFrom := s.FromBytes(b)
+			assertNoError(t, errFrom)
+			sb, errTo := s.ToBytes()
+			assertNoError(t, errTo)
+			if !bytes.Equal(b, sb) {
+				t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+			}
+		}()
+	}
+}
+
+func Test_RDPNegRsp_ProcessBytes(t *testing.T) {
+	b := packetCCfNegRsp[7:15]
+	s := &RDPNegRsp{}
+	errFrom := s.FromBytes(b)
+	assertNoError(t, errFrom)
+	sb, errTo := s.ToBytes()
+	assertNoError(t, errTo)
+	if !bytes.Equal(b, sb) {
+		t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+	}
+}
+
+func Test_RDPNegFailure_ProcessBytes(t *testing.T) {
+	b := packetCCfNegFailure[7:15]
+	s := &RDPNegFailure{}
+	errFrom := s.FromBytes(b)
+	assertNoError(t, errFrom)
+	sb, errTo := s.ToBytes()
+	assertNoError(t, errTo)
+	if !bytes.Equal(b, sb) {
+		t.Fatalf("test %T bytes processing: resulting bytes [% x] don't match original bytes [% x]", *s, b, sb)
+	}
+}
+
+// Packet examples
+var packetCCfNoNeg = []byte{
+	0x06, 0xD0, 0x00, 0x00, 0x00, 0x00, 0x00, // X224Ccf
+}
+var packetCCfNegRsp = []byte{
+	0x0E, 0xD0, 0x00, 0x00, 0x00, 0x00, 0x00, // X224Ccf
+	0x02, 0x00, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, // RDPNegRsp
+}
+var packetCCfNegFailure = []byte{
+	0x0E, 0xD0, 0x00, 0x00, 0x00, 0x00, 0x00, // X224Ccf
+	0x03, 0x00, 0x08, 0x00, 0x02, 0x00, 0x00, 0x00, // RDPNegFailure
+}